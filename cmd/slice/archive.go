@@ -0,0 +1,213 @@
+package slice
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/bradfitz/iter"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// archiveInputReader wraps r so archive reads see an uncompressed tar
+// stream, detecting a gzip or bzip2 wrapper from its magic bytes and
+// passing plain tar straight through.
+func archiveInputReader(r io.Reader, opts SliceOptions) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	peek, err := br.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(peek, []byte{0x1f, 0x8b}):
+		return decompressReader(CodecGzip, br, opts)
+	case bytes.HasPrefix(peek, []byte("BZh")):
+		return decompressReader(CodecBzip2, br, opts)
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// archiveShard is one of SliceArchive's n output tar.gz archives and the
+// chain of writers that flush down to its file.
+type archiveShard struct {
+	tw     *tar.Writer
+	gzw    io.WriteCloser
+	outbuf *bufio.Writer
+	outf   io.Closer
+}
+
+// SliceArchive reads the `.tar`, `.tar.gz`, or `.tar.bz2` archive at
+// `filename` and writes n output tar.gz archives, distributing whole
+// entries (not lines) across shards round-robin. Directory and symlink
+// entries are replicated to every shard that ends up with one of their
+// descendants, so extracting any single shard yields a self-consistent
+// tree. A directory entry is written only as such an ancestor, so a
+// directory with no descendants in the archive appears in no shard.
+func SliceArchive(el *log.Logger, filename string, n int) (filenames []string, err error) {
+	// capture errors thrown by `must` helpers
+	defer func() {
+		r := recover()
+		if rerr, ok := r.(error); ok {
+			err = rerr
+		} else if r != nil {
+			panic(r)
+		}
+	}()
+
+	inputfile, _ := mustOpen(el, filename)
+	defer func() { err = inputfile.Close() }()
+
+	ar, err := archiveInputReader(inputfile, SliceOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = ar.Close() }()
+
+	basename := strings.TrimSuffix(filepath.Base(filename), ".gz")
+	basename = strings.TrimSuffix(basename, ".bz2")
+	basename = strings.TrimSuffix(basename, ".tar")
+
+	log.Printf("creating %d output archives", n)
+	shards := make([]*archiveShard, n)
+	for i := range iter.N(n) {
+		outfilename := fmt.Sprintf("%d_%s.tar.gz", i, basename)
+		filenames = append(filenames, outfilename)
+
+		outf := mustCreate(el, outfilename)
+		outbuf := bufio.NewWriter(outf)
+		gzw, err := compressWriter(CodecGzip, outbuf, SliceOptions{})
+		if err != nil {
+			el.Panicf("creating output codec for file %q: %v", outfilename, err)
+		}
+		tw := tar.NewWriter(gzw)
+		shards[i] = &archiveShard{tw: tw, gzw: gzw, outbuf: outbuf, outf: outf}
+		log.Printf("\toutput archive %d: %q", i, outfilename)
+		defer func(filename string) {
+			if err := tw.Close(); err != nil {
+				el.Printf("closing tar stream for file %q", outfilename)
+			}
+			if err := gzw.Close(); err != nil {
+				el.Printf("closing gzip stream for file %q", outfilename)
+			}
+			if err := outbuf.Flush(); err != nil {
+				el.Printf("flushing buffered stream for file %q", outfilename)
+			}
+			if err := outf.Close(); err != nil {
+				el.Printf("closing file %q", outfilename)
+			}
+		}(outfilename)
+	}
+
+	if err := multiplexArchive(tar.NewReader(ar), shards); err != nil {
+		return filenames, err
+	}
+
+	return filenames, nil
+}
+
+// multiplexArchive reads entries from tr and round-robins each one across
+// shards, lazily replicating a directory or symlink's header into every
+// shard that turns out to need it as an ancestor of a routed entry.
+func multiplexArchive(tr *tar.Reader, shards []*archiveShard) error {
+	outMod := len(shards)
+	entryIdx := 0
+
+	ancestors := map[string]*tar.Header{} // dir/symlink path -> its header
+	written := map[string]map[int]bool{}  // path -> set of shards it's been written to
+	regularShard := map[string]int{}      // regular file path -> shard holding its content, so hardlinks can follow it
+
+	writeAncestor := func(path string, idx int) error {
+		hdr, ok := ancestors[path]
+		if !ok || written[path][idx] {
+			return nil
+		}
+		if err := shards[idx].tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if written[path] == nil {
+			written[path] = map[int]bool{}
+		}
+		written[path][idx] = true
+		return nil
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			h := *hdr
+			ancestors[strings.TrimSuffix(hdr.Name, "/")] = &h
+			continue
+		}
+
+		var idx int
+		if hdr.Typeflag == tar.TypeLink {
+			// A hardlink has no content of its own; it must land in the
+			// same shard as the file it links to, or that shard alone
+			// can't be extracted. If the target hasn't been seen yet
+			// (outside this archive, or later in it), fall back to
+			// round-robin and accept the split.
+			if target, ok := regularShard[hdr.Linkname]; ok {
+				idx = target
+			} else {
+				idx = entryIdx % outMod
+				entryIdx++
+			}
+		} else {
+			idx = entryIdx % outMod
+			entryIdx++
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink {
+			h := *hdr
+			ancestors[strings.TrimSuffix(hdr.Name, "/")] = &h
+		}
+
+		for _, parent := range parentPaths(hdr.Name) {
+			if err := writeAncestor(parent, idx); err != nil {
+				return err
+			}
+		}
+
+		if err := shards[idx].tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			// Stream the body straight through instead of buffering it:
+			// a multi-GB layer entry would otherwise have to fit in
+			// memory whole.
+			if _, err := io.Copy(shards[idx].tw, tr); err != nil {
+				return err
+			}
+			regularShard[hdr.Name] = idx
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			name := strings.TrimSuffix(hdr.Name, "/")
+			if written[name] == nil {
+				written[name] = map[int]bool{}
+			}
+			written[name][idx] = true
+		}
+	}
+}
+
+// parentPaths returns name's ancestor directories, root-to-leaf, excluding
+// name itself and the archive root.
+func parentPaths(name string) []string {
+	name = strings.TrimSuffix(name, "/")
+	var parents []string
+	for dir := filepath.Dir(name); dir != "." && dir != "/" && dir != ""; dir = filepath.Dir(dir) {
+		parents = append([]string{dir}, parents...)
+	}
+	return parents
+}
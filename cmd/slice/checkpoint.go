@@ -0,0 +1,110 @@
+package slice
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// checkpoint is the on-disk sidecar a resumable Slice run uses to pick
+// back up after an interruption. It's written atomically
+// (write-temp-then-rename) every time a shard's gzip member is flushed,
+// so a crash never leaves it pointing past what's actually durable.
+type checkpoint struct {
+	// LinesConsumed is how many input lines have already been routed to
+	// an output. Because a compressed input stream generally can't be
+	// seeked into mid-member, resuming re-decompresses the input from the
+	// start and skips this many lines rather than seeking to a byte
+	// offset.
+	LinesConsumed int64 `json:"lines_consumed"`
+	// BytesConsumed is the total decompressed size of those lines. It is
+	// recorded only; resuming does not read or check it.
+	BytesConsumed int64 `json:"bytes_consumed"`
+
+	Shards []shardCheckpoint `json:"shards"`
+}
+
+// shardCheckpoint is one output's durable state as of the last flush.
+type shardCheckpoint struct {
+	Filename string `json:"filename"`
+	// FlushedBytes is the output file's size, in bytes, as of the last
+	// complete gzip member. Anything past this offset is a partial
+	// member from an interrupted run and gets truncated away on resume.
+	FlushedBytes int64 `json:"flushed_bytes"`
+	// FlushedHash is the xxhash of the first FlushedBytes bytes of the
+	// output file, checked by opts.Verify before trusting FlushedBytes.
+	FlushedHash uint64 `json:"flushed_hash"`
+	// Lines is how many input lines this shard has received so far.
+	Lines int64 `json:"lines"`
+	// Bytes is how many uncompressed bytes this shard has received so
+	// far.
+	Bytes int64 `json:"bytes"`
+}
+
+func checkpointPath(filename string) string {
+	return filepath.Base(filename) + ".slice-ckpt.json"
+}
+
+// loadCheckpoint returns nil, nil if path doesn't exist: a fresh run.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var ck checkpoint
+	if err := json.NewDecoder(f).Decode(&ck); err != nil {
+		return nil, fmt.Errorf("slice: corrupt checkpoint %q: %w", path, err)
+	}
+	return &ck, nil
+}
+
+// saveCheckpoint writes ck to path atomically: write to a temp file in the
+// same directory, fsync, then rename over path.
+func saveCheckpoint(path string, ck *checkpoint) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer func() { _ = os.Remove(tmpName) }() // no-op once renamed away
+
+	enc := json.NewEncoder(tmp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(ck); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
+
+// hashFilePrefix returns the xxhash of the first n bytes of the file at
+// path, for opts.Verify to compare against a checkpoint's FlushedHash.
+func hashFilePrefix(path string, n int64) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := xxhash.New()
+	if _, err := io.CopyN(h, bufio.NewReader(f), n); err != nil && err != io.EOF {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
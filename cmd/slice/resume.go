@@ -0,0 +1,277 @@
+package slice
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/bradfitz/iter"
+	"github.com/dustin/go-humanize"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// defaultCheckpointBytes is how often, in uncompressed bytes summed across
+// all shards, sliceResumable flushes every shard's gzip member and updates
+// the checkpoint when opts.CheckpointEvery is left at zero.
+const defaultCheckpointBytes = 64 << 20 // 64MiB
+
+// resumableShard is one output file of a resumable Slice run. Its gzip
+// stream is periodically flushed as a complete, independent member:
+// closing the current *pgzip.Writer ends a member, and wrapping the same
+// underlying file in a fresh one starts the next, since a gzip file is
+// just a concatenation of independent members.
+type resumableShard struct {
+	filename string
+	opts     SliceOptions
+
+	outf   *os.File
+	outbuf *bufio.Writer
+	cw     io.WriteCloser
+}
+
+// newResumableShard opens filename for writing, truncating it back to
+// startAt (the last flush point from a checkpoint, or 0 on a fresh run)
+// before appending a fresh gzip member there.
+func newResumableShard(filename string, opts SliceOptions, startAt int64) (*resumableShard, error) {
+	outf, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := outf.Truncate(startAt); err != nil {
+		_ = outf.Close()
+		return nil, err
+	}
+	if _, err := outf.Seek(startAt, io.SeekStart); err != nil {
+		_ = outf.Close()
+		return nil, err
+	}
+
+	s := &resumableShard{filename: filename, opts: opts, outf: outf}
+	s.outbuf = bufio.NewWriter(outf)
+	cw, err := compressWriter(opts.Codec, s.outbuf, opts)
+	if err != nil {
+		_ = outf.Close()
+		return nil, err
+	}
+	s.cw = cw
+	return s, nil
+}
+
+func (s *resumableShard) write(line []byte) error {
+	_, err := s.cw.Write(line)
+	return err
+}
+
+// flush closes out the current gzip member, making everything written so
+// far durable and independently readable, then opens a fresh member so
+// writing can continue. It returns the shard's new on-disk size and the
+// hash of its contents, for the caller to checkpoint.
+func (s *resumableShard) flush() (size int64, hash uint64, err error) {
+	if err := s.cw.Close(); err != nil {
+		return 0, 0, err
+	}
+	if err := s.outbuf.Flush(); err != nil {
+		return 0, 0, err
+	}
+	if err := s.outf.Sync(); err != nil {
+		return 0, 0, err
+	}
+
+	fi, err := s.outf.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cw, err := compressWriter(s.opts.Codec, s.outbuf, s.opts)
+	if err != nil {
+		return 0, 0, err
+	}
+	s.cw = cw
+
+	h, err := hashFilePrefix(s.filename, fi.Size())
+	if err != nil {
+		return 0, 0, err
+	}
+	return fi.Size(), h, nil
+}
+
+func (s *resumableShard) close() error {
+	if err := s.cw.Close(); err != nil {
+		return err
+	}
+	if err := s.outbuf.Flush(); err != nil {
+		return err
+	}
+	return s.outf.Close()
+}
+
+// sliceResumable is Slice's checkpointed path, taken when opts.Resume is
+// set. It's only meaningful for opts.Codec == CodecGzip, since resuming
+// relies on gzip files being a concatenation of independent members.
+func sliceResumable(el *log.Logger, filename string, n int, opts SliceOptions) (shards []ShardInfo, err error) {
+	if opts.Codec != CodecGzip {
+		return nil, fmt.Errorf("slice: Resume only supports CodecGzip, got codec %d", opts.Codec)
+	}
+
+	defer func() {
+		r := recover()
+		if rerr, ok := r.(error); ok {
+			err = rerr
+		} else if r != nil {
+			panic(r)
+		}
+	}()
+
+	ckptPath := checkpointPath(filename)
+	ck, err := loadCheckpoint(ckptPath)
+	if err != nil {
+		return nil, err
+	}
+
+	basename := filepath.Base(filename)
+	outShards := make([]*resumableShard, n)
+	shardCkpts := make([]shardCheckpoint, n)
+	for i := range iter.N(n) {
+		outfilename := fmt.Sprintf("%d_%s", i, basename)
+
+		sc := shardCheckpoint{Filename: outfilename}
+		if ck != nil && i < len(ck.Shards) {
+			sc = ck.Shards[i]
+			if opts.Verify {
+				h, err := hashFilePrefix(outfilename, sc.FlushedBytes)
+				if err != nil {
+					return nil, fmt.Errorf("slice: verifying checkpoint for %q: %w", outfilename, err)
+				}
+				if h != sc.FlushedHash {
+					return nil, fmt.Errorf("slice: checkpoint for %q doesn't match the file on disk, refusing to resume", outfilename)
+				}
+			}
+		}
+
+		shard, err := newResumableShard(outfilename, opts, sc.FlushedBytes)
+		if err != nil {
+			return nil, err
+		}
+		outShards[i] = shard
+		shardCkpts[i] = sc
+		log.Printf("\toutput file %d: %q (resuming at byte %d, %d lines)", i, outfilename, sc.FlushedBytes, sc.Lines)
+	}
+	defer func() {
+		for _, s := range outShards {
+			if cerr := s.close(); cerr != nil {
+				el.Printf("closing output %q: %v", s.filename, cerr)
+			}
+		}
+	}()
+
+	var skipLines int64
+	if ck != nil {
+		skipLines = ck.LinesConsumed
+	}
+
+	checkpointEvery := opts.CheckpointEvery
+	if checkpointEvery <= 0 {
+		checkpointEvery = defaultCheckpointBytes
+	}
+
+	inputfile, size := mustOpen(el, filename)
+	defer func() { err = inputfile.Close() }()
+
+	lines := make(chan []byte, n*2)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- multiplexResumable(outShards, shardCkpts, lines, skipLines, checkpointEvery, ckptPath)
+	}()
+
+	log.Printf("reading lines from %q (%s), skipping %d already-processed lines", filename, humanize.Bytes(uint64(size)), skipLines)
+	if err := readLines(inputfile, size, lines, opts); err != nil {
+		el.Printf("reading lines from input failed: %v", err)
+	}
+
+	werr := <-errc
+
+	shards = make([]ShardInfo, n)
+	for i, sc := range shardCkpts {
+		shards[i] = ShardInfo{Filename: sc.Filename, Lines: sc.Lines, Bytes: sc.Bytes}
+	}
+
+	if werr != nil {
+		return shards, werr
+	}
+	return shards, nil
+}
+
+// multiplexResumable round-robins lines across shards like multiplexLines,
+// but skips the first skipLines (already durably written in a prior run)
+// and periodically flushes every shard's gzip member and the checkpoint
+// once checkpointEvery uncompressed bytes have been written since the
+// last flush.
+func multiplexResumable(shards []*resumableShard, shardCkpts []shardCheckpoint, lines <-chan []byte, skipLines, checkpointEvery int64, ckptPath string) error {
+	outMod := len(shards)
+	outIdx := 0
+	var consumedLines, consumedBytes, sinceFlush int64
+	wroteNew := false
+
+	for line := range lines {
+		consumedLines++
+		consumedBytes += int64(len(line))
+		if consumedLines <= skipLines {
+			// already durably written in a prior run; keep the
+			// round-robin cursor in sync without rewriting it
+			outIdx = (outIdx + 1) % outMod
+			continue
+		}
+
+		wroteNew = true
+		if err := shards[outIdx].write(line); err != nil {
+			return fmt.Errorf("writing to output %q: %w", shards[outIdx].filename, err)
+		}
+		shardCkpts[outIdx].Lines++
+		shardCkpts[outIdx].Bytes += int64(len(line))
+		sinceFlush += int64(len(line))
+		outIdx = (outIdx + 1) % outMod
+
+		if sinceFlush >= checkpointEvery {
+			if err := flushCheckpoint(shards, shardCkpts, consumedLines, consumedBytes, ckptPath); err != nil {
+				return err
+			}
+			sinceFlush = 0
+		}
+	}
+
+	if !wroteNew {
+		// Every line was already durably written in a prior run: this
+		// call is a genuine no-op. Leave the shards and checkpoint
+		// untouched instead of appending an empty gzip member to each
+		// shard and rewriting an unchanged checkpoint.
+		return nil
+	}
+
+	// Flush and save the checkpoint one last time instead of deleting it:
+	// the checkpoint is also how a later Resume call recognizes "already
+	// fully processed" (skipLines ends up covering every line, so the
+	// !wroteNew branch above fires and nothing is touched). Deleting it on
+	// success would erase that record, so the next Resume call would see
+	// no checkpoint, default every shard's FlushedBytes to 0, and truncate
+	// the finished output back to empty to reprocess the whole input.
+	return flushCheckpoint(shards, shardCkpts, consumedLines, consumedBytes, ckptPath)
+}
+
+func flushCheckpoint(shards []*resumableShard, shardCkpts []shardCheckpoint, linesConsumed, bytesConsumed int64, ckptPath string) error {
+	for i, s := range shards {
+		size, hash, err := s.flush()
+		if err != nil {
+			return fmt.Errorf("flushing output %q: %w", s.filename, err)
+		}
+		shardCkpts[i].FlushedBytes = size
+		shardCkpts[i].FlushedHash = hash
+	}
+
+	ck := &checkpoint{
+		LinesConsumed: linesConsumed,
+		BytesConsumed: bytesConsumed,
+		Shards:        append([]shardCheckpoint(nil), shardCkpts...),
+	}
+	return saveCheckpoint(ckptPath, ck)
+}
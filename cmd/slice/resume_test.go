@@ -0,0 +1,199 @@
+package slice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+func writeGzipInput(t *testing.T, path string, lines []string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("creating input %q: %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	zw := gzip.NewWriter(f)
+	for _, l := range lines {
+		if _, err := zw.Write([]byte(l)); err != nil {
+			t.Fatalf("writing input line: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing input writer: %v", err)
+	}
+}
+
+// readShard decompresses every gzip member in a (possibly multi-member)
+// output shard and returns the concatenated plaintext. compress/gzip's
+// Reader follows RFC 1952 and reads across member boundaries by default,
+// same as the pgzip reader Slice itself would use to read it back.
+func readShard(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening shard %q: %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("opening gzip reader for %q: %v", path, err)
+	}
+	defer func() { _ = zr.Close() }()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, zr); err != nil {
+		t.Fatalf("reading shard %q: %v", path, err)
+	}
+	return buf.String()
+}
+
+// TestResumeRoundTrip simulates a crash partway through a resumable Slice
+// run (a periodic checkpoint lands on disk, then the process disappears
+// before the run finishes) and checks that restarting picks up exactly
+// where the checkpoint left off, producing output identical to an
+// uninterrupted single pass over the same input.
+func TestResumeRoundTrip(t *testing.T) {
+	const n = 3
+	const numLines = 40
+	const basename = "input.jsonl.gz"
+
+	var lines []string
+	for i := 0; i < numLines; i++ {
+		lines = append(lines, fmt.Sprintf(`{"id":%d}`+"\n", i))
+	}
+
+	el := log.New(io.Discard, "", 0)
+
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	defer func() { _ = os.Chdir(origDir) }()
+
+	// --- single, uninterrupted pass: the baseline every resumed run must match ---
+	singleDir := t.TempDir()
+	if err := os.Chdir(singleDir); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	writeGzipInput(t, basename, lines)
+
+	wantShards, err := Slice(el, basename, n, SliceOptions{})
+	if err != nil {
+		t.Fatalf("Slice (single pass): %v", err)
+	}
+	want := make([]string, n)
+	for i, s := range wantShards {
+		want[i] = readShard(t, s.Filename)
+	}
+
+	// --- interrupted run: crash right after a periodic checkpoint, then resume ---
+	resumeDir := t.TempDir()
+	if err := os.Chdir(resumeDir); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	writeGzipInput(t, basename, lines)
+
+	opts := SliceOptions{Resume: true}
+	ckptPath := checkpointPath(basename)
+
+	const crashAfter = 17 // short of numLines, so the run is genuinely incomplete
+	shards := make([]*resumableShard, n)
+	shardCkpts := make([]shardCheckpoint, n)
+	for i := 0; i < n; i++ {
+		outfilename := fmt.Sprintf("%d_%s", i, basename)
+		shard, err := newResumableShard(outfilename, opts, 0)
+		if err != nil {
+			t.Fatalf("newResumableShard: %v", err)
+		}
+		shards[i] = shard
+		shardCkpts[i] = shardCheckpoint{Filename: outfilename}
+	}
+
+	var bytesConsumed int64
+	outIdx := 0
+	for i := 0; i < crashAfter; i++ {
+		line := []byte(lines[i])
+		if err := shards[outIdx].write(line); err != nil {
+			t.Fatalf("writing line %d: %v", i, err)
+		}
+		shardCkpts[outIdx].Lines++
+		shardCkpts[outIdx].Bytes += int64(len(line))
+		bytesConsumed += int64(len(line))
+		outIdx = (outIdx + 1) % n
+	}
+	if err := flushCheckpoint(shards, shardCkpts, crashAfter, bytesConsumed, ckptPath); err != nil {
+		t.Fatalf("flushCheckpoint: %v", err)
+	}
+	// Simulate the process dying here: drop the file handles without
+	// closing the (already-flushed, freshly reopened) gzip members.
+	for _, s := range shards {
+		_ = s.outf.Close()
+	}
+
+	if _, err := os.Stat(ckptPath); err != nil {
+		t.Fatalf("checkpoint %q should exist after a mid-run flush: %v", ckptPath, err)
+	}
+
+	gotShards, err := Slice(el, basename, n, opts)
+	if err != nil {
+		t.Fatalf("Slice (resume): %v", err)
+	}
+
+	// The checkpoint stays on disk, finalized, rather than being deleted:
+	// it's what lets the next Resume call recognize "already fully
+	// processed" and skip every line instead of defaulting FlushedBytes to
+	// 0 and truncating the finished output back to empty.
+	if _, err := os.Stat(ckptPath); err != nil {
+		t.Fatalf("checkpoint %q should still exist after a clean finish: %v", ckptPath, err)
+	}
+
+	got := make([]string, n)
+	for i, s := range gotShards {
+		got[i] = readShard(t, s.Filename)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("shard %d content mismatch after resume\n got: %q\nwant: %q", i, got[i], want[i])
+		}
+	}
+
+	// A further Resume call against the now-finished run must be a true
+	// no-op: the checkpoint already covers every line, so nothing gets
+	// rewritten and re-reading the shards still round-trips to the same
+	// content.
+	finalInfo := make([]os.FileInfo, n)
+	for i, s := range gotShards {
+		fi, err := os.Stat(s.Filename)
+		if err != nil {
+			t.Fatalf("stat %q: %v", s.Filename, err)
+		}
+		finalInfo[i] = fi
+	}
+
+	noopShards, err := Slice(el, basename, n, opts)
+	if err != nil {
+		t.Fatalf("Slice (no-op resume): %v", err)
+	}
+	for i, s := range noopShards {
+		fi, err := os.Stat(s.Filename)
+		if err != nil {
+			t.Fatalf("stat %q: %v", s.Filename, err)
+		}
+		if fi.Size() != finalInfo[i].Size() {
+			t.Fatalf("shard %d size changed on a no-op resume: %d -> %d", i, finalInfo[i].Size(), fi.Size())
+		}
+		if readShard(t, s.Filename) != want[i] {
+			t.Fatalf("shard %d content changed on a no-op resume", i)
+		}
+	}
+	if _, err := os.Stat(ckptPath); err != nil {
+		t.Fatalf("checkpoint %q should still exist after a no-op resume: %v", ckptPath, err)
+	}
+}
@@ -0,0 +1,160 @@
+package slice
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// compressedSizeCheckBytes bounds how often full() pays for a compressor
+// flush + Stat when opts.MaxBytesBasis is BasisCompressed: once every this
+// many uncompressed bytes land in the current shard, not on every line.
+// Flushing per line would serialize pgzip's parallel block workers and add
+// a sync marker to the output for every single line.
+const compressedSizeCheckBytes = 4 << 20 // 4MiB
+
+// rolloverShard is the single output sliceRollover is currently writing
+// to, plus the counters that decide when it's full.
+type rolloverShard struct {
+	info ShardInfo
+
+	outf   *os.File
+	outbuf *bufio.Writer
+	cw     io.WriteCloser
+
+	// bytesAtLastSizeCheck is info.Bytes as of the last time full() paid
+	// for a compressed-size check, so BasisCompressed only re-checks once
+	// compressedSizeCheckBytes more has been written.
+	bytesAtLastSizeCheck int64
+}
+
+// sliceRollover is Slice's size-bounded path, taken when
+// opts.MaxBytesPerShard or opts.MaxLinesPerShard is set. Rather than a
+// fixed number of outputs split round-robin, it writes to one growing
+// "part-00000.gz"-style output at a time and opens the next part whenever
+// the current one hits either limit.
+func sliceRollover(el *log.Logger, filename string, opts SliceOptions) (shards []ShardInfo, err error) {
+	// capture errors thrown by `must` helpers
+	defer func() {
+		r := recover()
+		if rerr, ok := r.(error); ok {
+			err = rerr
+		} else if r != nil {
+			panic(r)
+		}
+	}()
+
+	inputfile, size := mustOpen(el, filename)
+	defer func() { err = inputfile.Close() }()
+
+	lines := make(chan []byte, 64)
+	start := time.Now()
+
+	var cur *rolloverShard
+	newShard := func() error {
+		outfilename := fmt.Sprintf("part-%05d%s", len(shards), codecExtension(opts.Codec))
+		outf := mustCreate(el, outfilename)
+		outbuf := bufio.NewWriter(outf)
+		cw, err := compressWriter(opts.Codec, outbuf, opts)
+		if err != nil {
+			return fmt.Errorf("creating output codec for file %q: %w", outfilename, err)
+		}
+		log.Printf("\toutput part %d: %q", len(shards), outfilename)
+		cur = &rolloverShard{info: ShardInfo{Filename: outfilename}, outf: outf, outbuf: outbuf, cw: cw}
+		shards = append(shards, cur.info)
+		return nil
+	}
+	closeShard := func(s *rolloverShard) error {
+		if err := s.cw.Close(); err != nil {
+			return err
+		}
+		if err := s.outbuf.Flush(); err != nil {
+			return err
+		}
+		return s.outf.Close()
+	}
+
+	if err := newShard(); err != nil {
+		return nil, err
+	}
+
+	full := func(s *rolloverShard) (bool, error) {
+		if opts.MaxLinesPerShard > 0 && s.info.Lines >= opts.MaxLinesPerShard {
+			return true, nil
+		}
+		if opts.MaxBytesPerShard <= 0 {
+			return false, nil
+		}
+		switch opts.MaxBytesBasis {
+		case BasisCompressed:
+			if s.info.Bytes-s.bytesAtLastSizeCheck < compressedSizeCheckBytes {
+				return false, nil
+			}
+			s.bytesAtLastSizeCheck = s.info.Bytes
+
+			// The compressor (pgzip's block workers, zstd's window,
+			// etc.) can hold several MB that haven't reached outbuf yet;
+			// without flushing it first, the size check lags and shards
+			// overshoot MaxBytesPerShard.
+			if f, ok := s.cw.(interface{ Flush() error }); ok {
+				if err := f.Flush(); err != nil {
+					return false, err
+				}
+			}
+			if err := s.outbuf.Flush(); err != nil {
+				return false, err
+			}
+			fi, err := s.outf.Stat()
+			if err != nil {
+				return false, err
+			}
+			return fi.Size() >= opts.MaxBytesPerShard, nil
+		default: // BasisUncompressed
+			return s.info.Bytes >= opts.MaxBytesPerShard, nil
+		}
+	}
+
+	go func() {
+		if err := readLines(inputfile, size, lines, opts); err != nil {
+			el.Printf("reading lines from input failed: %v", err)
+		}
+	}()
+
+	for line := range lines {
+		if _, err := cur.cw.Write(line); err != nil {
+			return shards, fmt.Errorf("writing to output %q: %w", cur.info.Filename, err)
+		}
+		cur.info.Lines++
+		cur.info.Bytes += int64(len(line))
+		shards[len(shards)-1] = cur.info
+
+		isFull, err := full(cur)
+		if err != nil {
+			return shards, err
+		}
+		if isFull {
+			if err := closeShard(cur); err != nil {
+				return shards, err
+			}
+			if err := newShard(); err != nil {
+				return shards, err
+			}
+		}
+	}
+
+	if err := closeShard(cur); err != nil {
+		return shards, err
+	}
+	shards[len(shards)-1] = cur.info
+
+	var totalBytes uint64
+	for _, s := range shards {
+		totalBytes += uint64(s.Bytes)
+	}
+	log.Printf("done writing %d parts (%s) in %v", len(shards), humanize.Bytes(totalBytes), time.Since(start))
+	return shards, nil
+}
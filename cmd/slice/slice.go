@@ -2,24 +2,285 @@ package slice
 
 import (
 	"bufio"
-	"compress/gzip"
+	"bytes"
+	"compress/bzip2"
+	"encoding/json"
 	"fmt"
 	"github.com/bradfitz/iter"
 	"github.com/cheggaaa/pb"
 	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+	"hash/fnv"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"time"
 )
 
+// defaultBlockSize is pgzip's own default block size, used when
+// SliceOptions.BlockSize is left at zero.
+const defaultBlockSize = 1 << 20 // 1MiB
+
+// concurrency returns n if positive, otherwise GOMAXPROCS.
+func concurrency(n int) int {
+	if n > 0 {
+		return n
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// blockSize returns n if positive, otherwise defaultBlockSize.
+func blockSize(n int) int {
+	if n > 0 {
+		return n
+	}
+	return defaultBlockSize
+}
+
+// Codec identifies a compression format that Slice can read from an input
+// file or write to its output shards.
+type Codec int
+
+const (
+	// CodecGzip is the historical default, used for both input and output.
+	CodecGzip Codec = iota
+	CodecBzip2
+	CodecZstd
+	CodecLZ4
+	CodecXZ
+	CodecS2
+)
+
+// codecExtension returns the conventional file extension for codec, used
+// to name shards whose filename isn't otherwise derived from the input.
+func codecExtension(codec Codec) string {
+	switch codec {
+	case CodecGzip:
+		return ".gz"
+	case CodecBzip2:
+		return ".bz2"
+	case CodecZstd:
+		return ".zst"
+	case CodecLZ4:
+		return ".lz4"
+	case CodecXZ:
+		return ".xz"
+	case CodecS2:
+		return ".s2"
+	default:
+		return ""
+	}
+}
+
+// codecMagic pairs a codec with the magic bytes that identify it at the
+// start of a file. Entries are checked longest-prefix-first isn't required
+// since the magics don't collide.
+var codecMagic = []struct {
+	codec Codec
+	magic []byte
+}{
+	{CodecGzip, []byte{0x1f, 0x8b}},
+	{CodecBzip2, []byte("BZh")},
+	{CodecZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CodecLZ4, []byte{0x04, 0x22, 0x4d, 0x18}},
+	{CodecXZ, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{CodecS2, []byte{0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y'}},
+	{CodecS2, []byte{0xff, 0x06, 0x00, 0x00, 'S', '2', 's', 'T', 'w', 'O'}},
+}
+
+// sniffCodec peeks at the front of r to detect which codec it was
+// compressed with, without consuming any bytes.
+func sniffCodec(r *bufio.Reader) (Codec, error) {
+	longest := 0
+	for _, m := range codecMagic {
+		if len(m.magic) > longest {
+			longest = len(m.magic)
+		}
+	}
+	peek, err := r.Peek(longest)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	for _, m := range codecMagic {
+		if bytes.HasPrefix(peek, m.magic) {
+			return m.codec, nil
+		}
+	}
+	return 0, fmt.Errorf("slice: couldn't detect input codec from leading bytes %x", peek)
+}
+
+// decompressReader wraps r in the decompressor for codec. opts' Read*
+// fields tune the pgzip pipeline used for CodecGzip; they're ignored for
+// every other codec.
+func decompressReader(codec Codec, r io.Reader, opts SliceOptions) (io.ReadCloser, error) {
+	switch codec {
+	case CodecGzip:
+		return pgzip.NewReaderN(r, blockSize(opts.BlockSize), concurrency(opts.ReadConcurrency))
+	case CodecBzip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case CodecZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case CodecLZ4:
+		return io.NopCloser(lz4.NewReader(r)), nil
+	case CodecXZ:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case CodecS2:
+		return io.NopCloser(s2.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("slice: unknown input codec %d", codec)
+	}
+}
+
+// compressWriter wraps w in the compressor for codec. opts' Write* fields
+// tune the pgzip pipeline used for CodecGzip; they're ignored for every
+// other codec.
+func compressWriter(codec Codec, w io.Writer, opts SliceOptions) (io.WriteCloser, error) {
+	switch codec {
+	case CodecGzip:
+		zw := pgzip.NewWriter(w)
+		if err := zw.SetConcurrency(blockSize(opts.BlockSize), concurrency(opts.WriteConcurrency)); err != nil {
+			return nil, err
+		}
+		return zw, nil
+	case CodecBzip2:
+		// compress/bzip2 only implements a reader; there's no bzip2 encoder
+		// in the stdlib or in anything else this package already depends
+		// on, so bzip2 is input-only for now.
+		return nil, fmt.Errorf("slice: bzip2 output isn't supported, bzip2 is input-only")
+	case CodecZstd:
+		return zstd.NewWriter(w)
+	case CodecLZ4:
+		return lz4.NewWriter(w), nil
+	case CodecXZ:
+		return xz.NewWriter(w)
+	case CodecS2:
+		return s2.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("slice: unknown output codec %d", codec)
+	}
+}
+
 type sliceTask struct {
 	elog *log.Logger
 }
 
-// Slice creates n subparts from the gzip'd JSON file at `filename`.
-func Slice(el *log.Logger, filename string, n int) (filenames []string, err error) {
+// SliceOptions controls optional, non-default behavior of Slice. The zero
+// value reproduces the historical behavior: gzip in, gzip out.
+type SliceOptions struct {
+	// Codec selects the compression format used for the n output files.
+	// The input's codec is always auto-detected from its magic bytes,
+	// regardless of this setting.
+	Codec Codec
+
+	// ReadConcurrency is the number of goroutines pgzip uses to decompress
+	// a gzip input in parallel. Ignored unless the input turns out to be
+	// gzip. Zero means GOMAXPROCS.
+	ReadConcurrency int
+	// WriteConcurrency is the number of goroutines pgzip uses to compress
+	// each output shard in parallel. Ignored unless opts.Codec is
+	// CodecGzip. Zero means GOMAXPROCS.
+	WriteConcurrency int
+	// BlockSize is the size in bytes of each independently (de)compressed
+	// pgzip block. Zero means pgzip's own default, ~1MiB.
+	BlockSize int
+
+	// OnMissingKey controls what SliceBy does with a line that doesn't
+	// have the requested key. Ignored by Slice.
+	OnMissingKey KeyFallback
+
+	// Resume makes Slice checkpoint its progress to a
+	// "<basename>.slice-ckpt.json" sidecar and pick back up from it on a
+	// later call with the same filename and n, instead of starting over.
+	// Only supported for CodecGzip.
+	Resume bool
+	// Verify re-hashes each output's already-flushed bytes against the
+	// checkpoint before resuming, instead of trusting it outright.
+	Verify bool
+	// CheckpointEvery is how many uncompressed bytes Slice writes, summed
+	// across all shards, before flushing every shard's gzip member and
+	// updating the checkpoint. Zero means defaultCheckpointBytes.
+	CheckpointEvery int64
+
+	// MaxBytesPerShard, if set, replaces Slice's fixed-N model: instead
+	// of splitting the input across n outputs round-robin, lines are
+	// written to a single growing "part-00000.gz"-style output until it
+	// reaches this many bytes (per MaxBytesBasis), then a new part is
+	// opened. n is ignored when this is set.
+	MaxBytesPerShard int64
+	// MaxBytesBasis selects whether MaxBytesPerShard is measured against
+	// uncompressed or on-disk compressed size.
+	MaxBytesBasis ByteBasis
+	// MaxLinesPerShard, if set, rolls over to a new part after this many
+	// lines, same as MaxBytesPerShard but counting lines. Combinable with
+	// MaxBytesPerShard: whichever limit is hit first rolls over.
+	MaxLinesPerShard int64
+}
+
+// KeyFallback controls how SliceBy handles a line that's missing the key
+// it's sharding by.
+type KeyFallback int
+
+const (
+	// FallbackRoundRobin routes a line missing its key to the next output
+	// in round-robin order, same as Slice. This is the zero value.
+	FallbackRoundRobin KeyFallback = iota
+	// FallbackSkip drops a line missing its key instead of writing it to
+	// any output.
+	FallbackSkip
+	// FallbackError stops writing at the first line missing its key; SliceBy
+	// then returns an error once the rest of the input has been read.
+	FallbackError
+)
+
+// ShardInfo describes one output produced by Slice or SliceBy: its
+// filename and how many lines and uncompressed bytes ended up in it.
+type ShardInfo struct {
+	Filename string
+	Lines    int64
+	Bytes    int64
+}
+
+// ByteBasis selects which byte count MaxBytesPerShard is measured against.
+type ByteBasis int
+
+const (
+	// BasisUncompressed measures MaxBytesPerShard against the
+	// uncompressed size written to a shard. This is the zero value.
+	BasisUncompressed ByteBasis = iota
+	// BasisCompressed measures MaxBytesPerShard against the shard file's
+	// on-disk (compressed) size, checked after each gzip flush.
+	BasisCompressed
+)
+
+// Slice creates n subparts from the compressed JSON file at `filename`. The
+// input's codec is auto-detected; opts.Codec controls the output codec. If
+// opts.MaxBytesPerShard or opts.MaxLinesPerShard is set, n is ignored and
+// Slice instead rolls over to a new "part-00000.gz"-style output whenever
+// a shard hits either limit. opts.Resume takes precedence: with it set,
+// Slice writes n outputs and both limits are ignored.
+func Slice(el *log.Logger, filename string, n int, opts SliceOptions) (shards []ShardInfo, err error) {
+	if opts.Resume {
+		return sliceResumable(el, filename, n, opts)
+	}
+	if opts.MaxBytesPerShard > 0 || opts.MaxLinesPerShard > 0 {
+		return sliceRollover(el, filename, opts)
+	}
+
 	slicer := sliceTask{elog: el}
 
 	// capture errors thrown by `must` helpers
@@ -38,18 +299,22 @@ func Slice(el *log.Logger, filename string, n int) (filenames []string, err erro
 	log.Printf("creating %d output files", n)
 	basename := filepath.Base(filename)
 	outputs := make([]io.Writer, n)
+	shards = make([]ShardInfo, n)
 	for i := range iter.N(n) {
 		outfilename := fmt.Sprintf("%d_%s", i, basename)
-		filenames = append(filenames, outfilename)
+		shards[i].Filename = outfilename
 
 		outf := mustCreate(el, outfilename)
 		outbuf := bufio.NewWriter(outf)
-		gzw := gzip.NewWriter(outbuf)
-		outputs[i] = gzw
+		cw, err := compressWriter(opts.Codec, outbuf, opts)
+		if err != nil {
+			el.Panicf("creating output codec for file %q: %v", outfilename, err)
+		}
+		outputs[i] = cw
 		log.Printf("\toutput file %d: %q", i, outfilename)
 		defer func(filename string) {
-			if err := gzw.Close(); err != nil {
-				el.Printf("closing gzip stream for file %q", outfilename)
+			if err := cw.Close(); err != nil {
+				el.Printf("closing compressed stream for file %q", outfilename)
 			}
 
 			if err := outbuf.Flush(); err != nil {
@@ -64,10 +329,10 @@ func Slice(el *log.Logger, filename string, n int) (filenames []string, err erro
 	lines := make(chan []byte, n*2)
 	doneWrite := make(chan struct{})
 	start := time.Now()
-	go slicer.multiplexLines(lines, outputs, doneWrite)
+	go slicer.multiplexLines(lines, outputs, shards, doneWrite)
 
 	log.Printf("reading lines from %q (%s)", filename, humanize.Bytes(uint64(size)))
-	if err := readLines(inputfile, size, lines); err != nil {
+	if err := readLines(inputfile, size, lines, opts); err != nil {
 		el.Printf("reading lines from input failed: %v", err)
 	}
 	log.Printf("done reading lines in %v", time.Since(start))
@@ -75,10 +340,10 @@ func Slice(el *log.Logger, filename string, n int) (filenames []string, err erro
 	<-doneWrite
 	log.Printf("done writing to outputs in %v", time.Since(start))
 
-	return filenames, nil
+	return shards, nil
 }
 
-func (st *sliceTask) multiplexLines(lines <-chan []byte, outputs []io.Writer, done chan<- struct{}) {
+func (st *sliceTask) multiplexLines(lines <-chan []byte, outputs []io.Writer, shards []ShardInfo, done chan<- struct{}) {
 	defer close(done)
 	outIdx := 0
 	outMod := len(outputs)
@@ -88,11 +353,241 @@ func (st *sliceTask) multiplexLines(lines <-chan []byte, outputs []io.Writer, do
 			st.elog.Printf("couldn't write to output %d: %v", outIdx, err)
 			return
 		}
+		shards[outIdx].Lines++
+		shards[outIdx].Bytes += int64(len(line))
 		outIdx = (outIdx + 1) % outMod
 	}
 }
 
-func readLines(r io.Reader, size int64, lines chan<- []byte) error {
+// SliceBy creates n subparts from the compressed JSON file at `filename`,
+// like Slice, but routes each line to output hash(key) % n instead of
+// round-robin, where key is the value found at the dotted keyPath (e.g.
+// "user.id"). This keeps every record for a given entity in the same
+// shard, which plain round-robin can't guarantee. Lines missing the key
+// fall back to opts.OnMissingKey.
+func SliceBy(el *log.Logger, filename string, n int, keyPath string, opts SliceOptions) (stats []ShardInfo, err error) {
+	keyer := keyedSliceTask{elog: el, keyPath: strings.Split(keyPath, "."), onMissing: opts.OnMissingKey}
+
+	// capture errors thrown by `must` helpers
+	defer func() {
+		r := recover()
+		if rerr, ok := r.(error); ok {
+			err = rerr
+		} else if r != nil {
+			panic(r)
+		}
+	}()
+
+	inputfile, size := mustOpen(el, filename)
+	defer func() { err = inputfile.Close() }()
+
+	log.Printf("creating %d output files, sharding by %q", n, keyPath)
+	basename := filepath.Base(filename)
+	outputs := make([]io.Writer, n)
+	stats = make([]ShardInfo, n)
+	for i := range iter.N(n) {
+		outfilename := fmt.Sprintf("%d_%s", i, basename)
+		stats[i].Filename = outfilename
+
+		outf := mustCreate(el, outfilename)
+		outbuf := bufio.NewWriter(outf)
+		cw, err := compressWriter(opts.Codec, outbuf, opts)
+		if err != nil {
+			el.Panicf("creating output codec for file %q: %v", outfilename, err)
+		}
+		outputs[i] = cw
+		log.Printf("\toutput file %d: %q", i, outfilename)
+		defer func(filename string) {
+			if err := cw.Close(); err != nil {
+				el.Printf("closing compressed stream for file %q", outfilename)
+			}
+
+			if err := outbuf.Flush(); err != nil {
+				el.Printf("flushing buffered stream for file %q", outfilename)
+			}
+			if err := outf.Close(); err != nil {
+				el.Printf("closing file %q", outfilename)
+			}
+		}(outfilename)
+	}
+
+	lines := make(chan []byte, n*2)
+	doneWrite := make(chan error, 1)
+	start := time.Now()
+	go keyer.multiplexLines(lines, outputs, stats, doneWrite)
+
+	log.Printf("reading lines from %q (%s)", filename, humanize.Bytes(uint64(size)))
+	if err := readLines(inputfile, size, lines, opts); err != nil {
+		el.Printf("reading lines from input failed: %v", err)
+	}
+	log.Printf("done reading lines in %v", time.Since(start))
+
+	if werr := <-doneWrite; werr != nil {
+		return stats, werr
+	}
+	log.Printf("done writing to outputs in %v", time.Since(start))
+
+	return stats, nil
+}
+
+type keyedSliceTask struct {
+	elog      *log.Logger
+	keyPath   []string
+	onMissing KeyFallback
+}
+
+func (st *keyedSliceTask) multiplexLines(lines <-chan []byte, outputs []io.Writer, stats []ShardInfo, done chan<- error) {
+	defer close(done)
+	// keep draining after an early return so readLines never blocks on a
+	// full channel and SliceBy can still receive the error
+	defer func() {
+		for range lines {
+		}
+	}()
+	outMod := len(outputs)
+	rrIdx := 0
+	for line := range lines {
+		idx, found, err := routeByKey(line, st.keyPath, outMod)
+		if err != nil && st.onMissing == FallbackError {
+			done <- fmt.Errorf("slice: extracting key %q: %w", strings.Join(st.keyPath, "."), err)
+			return
+		}
+		if err != nil || !found {
+			switch st.onMissing {
+			case FallbackSkip:
+				continue
+			case FallbackError:
+				done <- fmt.Errorf("slice: line missing key %q", strings.Join(st.keyPath, "."))
+				return
+			default: // FallbackRoundRobin
+				idx = rrIdx
+				rrIdx = (rrIdx + 1) % outMod
+			}
+		}
+
+		if _, err := outputs[idx].Write(line); err != nil {
+			st.elog.Printf("couldn't write to output %d: %v", idx, err)
+			return
+		}
+		stats[idx].Lines++
+		stats[idx].Bytes += int64(len(line))
+	}
+}
+
+// routeByKey extracts the value at keyPath from the JSON object in line
+// and hashes it down to an output index in [0, n). found is false when
+// the line is missing the key, in which case the caller decides what to
+// do per its fallback policy.
+func routeByKey(line []byte, keyPath []string, n int) (idx int, found bool, err error) {
+	val, found, err := extractKey(line, keyPath)
+	if err != nil || !found {
+		return 0, false, err
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(val))
+	return int(h.Sum32() % uint32(n)), true, nil
+}
+
+// extractKey stream-parses just enough of the JSON object in line to
+// return the string value at the dotted keyPath, without unmarshaling the
+// whole line.
+func extractKey(line []byte, keyPath []string) (string, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	// Without this, numeric keys decode to float64 and lose precision
+	// above 2^53 -- exactly the range real Shopify-scale ids live in --
+	// so distinct ids could collapse onto the same shard.
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return "", false, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return "", false, fmt.Errorf("line isn't a JSON object")
+	}
+	return descendKey(dec, keyPath)
+}
+
+// descendKey walks the object dec is positioned inside of, following path
+// one field at a time, skipping every field that isn't on the path.
+func descendKey(dec *json.Decoder, path []string) (string, bool, error) {
+	want, rest := path[0], path[1:]
+	for dec.More() {
+		keyTok, err := dec.Token()
+		if err != nil {
+			return "", false, err
+		}
+		key, _ := keyTok.(string)
+		if key != want {
+			if err := skipValue(dec); err != nil {
+				return "", false, err
+			}
+			continue
+		}
+		if len(rest) == 0 {
+			// Decode (rather than Token) the terminal value: a string is
+			// unquoted below, a number keeps its exact on-wire text
+			// (UseNumber is set above, so numbers aren't float64-rounded),
+			// and an object or array is captured whole instead of just its
+			// leading '{'/'[' delimiter, which would otherwise hash every
+			// such line to the same shard.
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return "", false, err
+			}
+			if string(raw) == "null" {
+				return "", false, nil
+			}
+			if raw[0] == '"' {
+				var s string
+				if err := json.Unmarshal(raw, &s); err != nil {
+					return "", false, err
+				}
+				return s, true, nil
+			}
+			return string(raw), true, nil
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return "", false, err
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+			return "", false, nil // keyPath expects an object here
+		}
+		return descendKey(dec, rest)
+	}
+	return "", false, nil
+}
+
+// skipValue consumes the next complete JSON value from dec, whatever its
+// shape, without returning it.
+func skipValue(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok || (delim != '{' && delim != '[') {
+		return nil // scalar, already consumed
+	}
+	depth := 1
+	for depth > 0 {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := tok.(json.Delim); ok {
+			switch d {
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+		}
+	}
+	return nil
+}
+
+func readLines(r io.Reader, size int64, lines chan<- []byte, opts SliceOptions) error {
 	defer close(lines)
 	bar := pb.New(int(size))
 	bar.ShowBar = true
@@ -103,13 +598,19 @@ func readLines(r io.Reader, size int64, lines chan<- []byte) error {
 	bar.SetUnits(pb.U_BYTES)
 	barr := bar.NewProxyReader(r)
 
-	gr, err := gzip.NewReader(barr)
+	sniffed := bufio.NewReader(barr)
+	codec, err := sniffCodec(sniffed)
 	if err != nil {
 		return err
 	}
-	defer func() { _ = gr.Close() }()
 
-	rd := bufio.NewReader(gr)
+	dr, err := decompressReader(codec, sniffed, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dr.Close() }()
+
+	rd := bufio.NewReader(dr)
 
 	bar.Start()
 	defer bar.FinishPrint("all lines were read")
@@ -148,4 +649,4 @@ func mustCreate(elog *log.Logger, filename string) *os.File {
 		elog.Panicf("couldn't create file %q: %v", filename, err)
 	}
 	return file
-}
\ No newline at end of file
+}
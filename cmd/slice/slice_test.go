@@ -0,0 +1,173 @@
+package slice
+
+import "testing"
+
+func TestExtractKey(t *testing.T) {
+	cases := []struct {
+		name      string
+		line      string
+		keyPath   []string
+		wantVal   string
+		wantFound bool
+		wantErr   bool
+	}{
+		{
+			name:      "top-level string key",
+			line:      `{"id":"abc123","shop":"acme"}`,
+			keyPath:   []string{"id"},
+			wantVal:   "abc123",
+			wantFound: true,
+		},
+		{
+			name:      "nested path",
+			line:      `{"user":{"id":42,"name":"pat"},"shop":"acme"}`,
+			keyPath:   []string{"user", "id"},
+			wantVal:   "42",
+			wantFound: true,
+		},
+		{
+			name:      "missing key",
+			line:      `{"shop":"acme"}`,
+			keyPath:   []string{"id"},
+			wantFound: false,
+		},
+		{
+			name:      "missing intermediate object",
+			line:      `{"shop":"acme"}`,
+			keyPath:   []string{"user", "id"},
+			wantFound: false,
+		},
+		{
+			name:      "intermediate value isn't an object",
+			line:      `{"user":"not-an-object"}`,
+			keyPath:   []string{"user", "id"},
+			wantFound: false,
+		},
+		{
+			name:      "null value",
+			line:      `{"id":null}`,
+			keyPath:   []string{"id"},
+			wantFound: false,
+		},
+		{
+			name:      "numeric id beyond float64's exact integer range",
+			line:      `{"id":9007199254740993}`,
+			keyPath:   []string{"id"},
+			wantVal:   "9007199254740993",
+			wantFound: true,
+		},
+		{
+			name:      "key appears after a sibling object and array",
+			line:      `{"meta":{"a":1,"b":[1,2,3]},"id":"xyz"}`,
+			keyPath:   []string{"id"},
+			wantVal:   "xyz",
+			wantFound: true,
+		},
+		{
+			name:      "object-valued key hashes on its full contents, not just '{'",
+			line:      `{"id":{"a":1,"b":2}}`,
+			keyPath:   []string{"id"},
+			wantVal:   `{"a":1,"b":2}`,
+			wantFound: true,
+		},
+		{
+			name:      "array-valued key hashes on its full contents, not just '['",
+			line:      `{"id":[1,2,3]}`,
+			keyPath:   []string{"id"},
+			wantVal:   `[1,2,3]`,
+			wantFound: true,
+		},
+		{
+			name:    "not a JSON object",
+			line:    `[1,2,3]`,
+			keyPath: []string{"id"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			val, found, err := extractKey([]byte(tc.line), tc.keyPath)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("extractKey() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if found != tc.wantFound {
+				t.Fatalf("extractKey() found = %v, want %v", found, tc.wantFound)
+			}
+			if found && val != tc.wantVal {
+				t.Fatalf("extractKey() val = %q, want %q", val, tc.wantVal)
+			}
+		})
+	}
+}
+
+// Two ids that differ well past 2^53 must not collapse to the same string
+// once stringified: that's exactly the precision loss UseNumber avoids.
+func TestExtractKeyDistinguishesLargeIDs(t *testing.T) {
+	a, found, err := extractKey([]byte(`{"id":9007199254740993}`), []string{"id"})
+	if err != nil || !found {
+		t.Fatalf("extractKey() = %q, %v, %v", a, found, err)
+	}
+	b, found, err := extractKey([]byte(`{"id":9007199254740994}`), []string{"id"})
+	if err != nil || !found {
+		t.Fatalf("extractKey() = %q, %v, %v", b, found, err)
+	}
+	if a == b {
+		t.Fatalf("distinct ids %q and %q stringified to the same key", a, b)
+	}
+}
+
+// Two distinct object values must not collapse to the same key: before
+// descendKey stringified the whole value, every object- or array-valued
+// key hashed on just its leading '{'/'[' delimiter.
+func TestExtractKeyDistinguishesObjectValues(t *testing.T) {
+	a, found, err := extractKey([]byte(`{"id":{"a":1}}`), []string{"id"})
+	if err != nil || !found {
+		t.Fatalf("extractKey() = %q, %v, %v", a, found, err)
+	}
+	b, found, err := extractKey([]byte(`{"id":{"a":2}}`), []string{"id"})
+	if err != nil || !found {
+		t.Fatalf("extractKey() = %q, %v, %v", b, found, err)
+	}
+	if a == b {
+		t.Fatalf("distinct object values %q and %q stringified to the same key", a, b)
+	}
+}
+
+func TestRouteByKeyMissingKey(t *testing.T) {
+	const n = 4
+	line := []byte(`{"shop":"acme"}`) // missing "id"
+
+	idx, found, err := routeByKey(line, []string{"id"}, n)
+	if err != nil {
+		t.Fatalf("routeByKey() error = %v", err)
+	}
+	if found {
+		t.Fatalf("routeByKey() found = true for a line missing its key")
+	}
+	if idx != 0 {
+		t.Fatalf("routeByKey() idx = %d on not-found, want the zero value 0", idx)
+	}
+}
+
+func TestRouteByKeyIsDeterministic(t *testing.T) {
+	line := []byte(`{"user":{"id":"abc-123"}}`)
+	keyPath := []string{"user", "id"}
+
+	first, found, err := routeByKey(line, keyPath, 8)
+	if err != nil || !found {
+		t.Fatalf("routeByKey() = %v, %v, %v", first, found, err)
+	}
+	for i := 0; i < 10; i++ {
+		got, found, err := routeByKey(line, keyPath, 8)
+		if err != nil || !found {
+			t.Fatalf("routeByKey() = %v, %v, %v", got, found, err)
+		}
+		if got != first {
+			t.Fatalf("routeByKey() not stable across calls: got %d, want %d", got, first)
+		}
+	}
+}